@@ -0,0 +1,295 @@
+package offheap
+
+import "sync"
+
+//----------------------------------------------
+//  Cache
+//
+//  Cache composes N shards, selected by integerHash(key) % N, each guarded
+//  by its own sync.Mutex. That gives safe concurrent Get/Set/Delete without
+//  serializing every caller on one lock the way a single map would.
+//
+//  A shard's entries live in a plain on-heap map[uint64]*cacheEntry rather
+//  than a HashTable: HashTable's Cell.Value is an interface{} backed by
+//  off-heap, mmap'd storage (see bucketArray's doc comment), and a cacheEntry
+//  -- along with whatever value it wraps -- needs to stay reachable from
+//  ordinary Go heap roots so the garbage collector can see it. Off-heap
+//  storage is for fixed-size, pointer-free payloads; an arbitrary cache value
+//  is neither.
+//
+//  Giving a shard a positive capacity turns on LRU eviction for it: Get
+//  promotes the accessed entry to the most-recently-used end of the shard's
+//  list, and Set evicts from the least-recently-used end -- invoking OnEvict,
+//  if one was supplied -- whenever the shard would otherwise grow past
+//  capacity. This mirrors goleveldb's cache, where a release callback runs
+//  as entries fall out.
+//----------------------------------------------
+
+// OnEvictFunc is invoked for every entry a Cache removes via LRU eviction or
+// a namespace purge. It runs outside the owning shard's lock, so it may
+// safely call back into the Cache.
+type OnEvictFunc func(key uint64, value interface{})
+
+// cacheEntry is what a shard's map actually stores. storageKey is the map
+// key (the caller's key for a plain Set, or the namespace-transformed key
+// for a Namespace.Set); key is always the caller's original, logical key --
+// the one OnEvictFunc should see -- even when storageKey differs from it.
+// hasNamespace distinguishes an entry actually written through Namespace(0)
+// from one written through a plain Cache.Set: both would otherwise leave
+// namespace at its zero value and be indistinguishable to dropNamespace.
+type cacheEntry struct {
+	storageKey   uint64
+	key          uint64
+	namespace    uint64
+	hasNamespace bool
+	value        interface{}
+	prev, next   *cacheEntry // LRU list links; unused when the shard has no capacity limit
+}
+
+type cacheShard struct {
+	mu       sync.Mutex
+	entries  map[uint64]*cacheEntry
+	capacity uint64 // 0 means unbounded: no LRU list is maintained
+	onEvict  OnEvictFunc
+
+	mru, lru *cacheEntry
+}
+
+func (s *cacheShard) pushFront(e *cacheEntry) {
+	e.prev = nil
+	e.next = s.mru
+	if s.mru != nil {
+		s.mru.prev = e
+	}
+	s.mru = e
+	if s.lru == nil {
+		s.lru = e
+	}
+}
+
+func (s *cacheShard) remove(e *cacheEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		s.mru = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		s.lru = e.prev
+	}
+	e.prev, e.next = nil, nil
+}
+
+func (s *cacheShard) touch(e *cacheEntry) {
+	if s.mru == e {
+		return
+	}
+	s.remove(e)
+	s.pushFront(e)
+}
+
+type Cache struct {
+	shards []cacheShard
+}
+
+// NewCache creates a Cache with shardCount shards, each an independent map
+// sized to hold about shardInitialSize entries. capacity, if non-zero,
+// bounds the number of live entries per shard and enables LRU eviction; pass
+// 0 for an unbounded cache. onEvict, if non-nil, is called for every entry
+// an eviction or a namespace purge removes.
+func NewCache(shardCount, shardInitialSize, capacity uint64, onEvict OnEvictFunc) *Cache {
+	if shardCount == 0 {
+		shardCount = 1
+	}
+
+	c := &Cache{shards: make([]cacheShard, shardCount)}
+	for i := range c.shards {
+		c.shards[i].entries = make(map[uint64]*cacheEntry, shardInitialSize)
+		c.shards[i].capacity = capacity
+		c.shards[i].onEvict = onEvict
+	}
+	return c
+}
+
+// Close drops every shard's entries. The cache must not be used afterwards.
+func (c *Cache) Close() {
+	for i := range c.shards {
+		c.shards[i].entries = nil
+	}
+}
+
+func (c *Cache) shardFor(key uint64) *cacheShard {
+	return &c.shards[integerHash(key)%uint64(len(c.shards))]
+}
+
+// Get returns the value stored for key, promoting it to most-recently-used
+// in its shard if the cache is capacity-bounded.
+func (c *Cache) Get(key uint64) (interface{}, bool) {
+	s := c.shardFor(key)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if s.capacity > 0 {
+		s.touch(e)
+	}
+	return e.value, true
+}
+
+// Set stores value for key, evicting least-recently-used entries from the
+// key's shard (and invoking OnEvict for each) if that shard is
+// capacity-bounded and now over capacity.
+func (c *Cache) Set(key uint64, value interface{}) {
+	c.set(key, key, 0, false, value)
+}
+
+// set stores value under storageKey (the map key), recording key as the
+// logical key OnEvictFunc should report for this entry -- they differ only
+// for namespaced entries, whose storageKey is namespace-transformed.
+// hasNamespace is false for a plain Cache.Set, so its entry can never match
+// a dropNamespace(id) purge no matter what id is passed -- a real namespace,
+// including id 0, always sets it true.
+func (c *Cache) set(storageKey, key, namespace uint64, hasNamespace bool, value interface{}) {
+	s := c.shardFor(storageKey)
+
+	s.mu.Lock()
+
+	e, exists := s.entries[storageKey]
+	if !exists {
+		e = &cacheEntry{storageKey: storageKey, key: key, namespace: namespace, hasNamespace: hasNamespace, value: value}
+		s.entries[storageKey] = e
+		if s.capacity > 0 {
+			s.pushFront(e)
+		}
+	} else {
+		e.value = value
+		e.namespace = namespace
+		e.hasNamespace = hasNamespace
+		if s.capacity > 0 {
+			s.touch(e)
+		}
+	}
+
+	var evicted []*cacheEntry
+	if s.capacity > 0 {
+		for uint64(len(s.entries)) > s.capacity && s.lru != nil {
+			victim := s.lru
+			s.remove(victim)
+			delete(s.entries, victim.storageKey)
+			evicted = append(evicted, victim)
+		}
+	}
+
+	onEvict := s.onEvict
+	s.mu.Unlock()
+
+	if onEvict != nil {
+		for _, victim := range evicted {
+			onEvict(victim.key, victim.value)
+		}
+	}
+}
+
+// Delete removes key from the cache, if present. It does not invoke
+// OnEvict: that callback is reserved for entries the cache removes on its
+// own, not ones the caller explicitly asked to go.
+func (c *Cache) Delete(key uint64) {
+	c.delete(key)
+}
+
+func (c *Cache) delete(storageKey uint64) {
+	s := c.shardFor(storageKey)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.entries[storageKey]
+	if !ok {
+		return
+	}
+	if s.capacity > 0 {
+		s.remove(e)
+	}
+	delete(s.entries, storageKey)
+}
+
+// Namespace partitions a shared Cache's keyspace by an application-chosen
+// id, so unrelated callers can share one set of shards without colliding on
+// keys, and each can later purge just its own entries with PurgeNamespace or
+// ZapNamespace.
+type Namespace struct {
+	cache *Cache
+	id    uint64
+}
+
+// Namespace returns a view of c scoped to id. Namespace views sharing the
+// same Cache share its shards and capacity limits.
+func (c *Cache) Namespace(id uint64) *Namespace {
+	return &Namespace{cache: c, id: id}
+}
+
+func (n *Namespace) namespacedKey(key uint64) uint64 {
+	return integerHash(key ^ (n.id * 0x9e3779b97f4a7c15))
+}
+
+func (n *Namespace) Get(key uint64) (interface{}, bool) {
+	return n.cache.Get(n.namespacedKey(key))
+}
+
+func (n *Namespace) Set(key uint64, value interface{}) {
+	n.cache.set(n.namespacedKey(key), key, n.id, true, value)
+}
+
+func (n *Namespace) Delete(key uint64) {
+	n.cache.delete(n.namespacedKey(key))
+}
+
+// PurgeNamespace removes every entry belonging to namespace id across all
+// shards, invoking the cache's OnEvict callback (if any) for each one with
+// the original, caller-given key -- not the namespace-transformed storage
+// key.
+func (c *Cache) PurgeNamespace(id uint64) {
+	c.dropNamespace(id, true)
+}
+
+// ZapNamespace removes every entry belonging to namespace id across all
+// shards without invoking OnEvict, for callers that already know what
+// they're discarding -- e.g. tearing down a namespace at shutdown.
+func (c *Cache) ZapNamespace(id uint64) {
+	c.dropNamespace(id, false)
+}
+
+func (c *Cache) dropNamespace(id uint64, notify bool) {
+	for i := range c.shards {
+		s := &c.shards[i]
+
+		s.mu.Lock()
+
+		var doomed []*cacheEntry
+		for _, e := range s.entries {
+			if e.hasNamespace && e.namespace == id {
+				doomed = append(doomed, e)
+			}
+		}
+		for _, e := range doomed {
+			if s.capacity > 0 {
+				s.remove(e)
+			}
+			delete(s.entries, e.storageKey)
+		}
+
+		onEvict := s.onEvict
+		s.mu.Unlock()
+
+		if notify && onEvict != nil {
+			for _, e := range doomed {
+				onEvict(e.key, e.value)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package offheap
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestCacheGetSetDelete(t *testing.T) {
+	c := NewCache(4, 8, 0, nil)
+	defer c.Close()
+
+	c.Set(1, "one")
+	c.Set(2, "two")
+
+	if v, ok := c.Get(1); !ok || v != "one" {
+		t.Fatalf("Get(1) = %v, %v", v, ok)
+	}
+
+	c.Delete(1)
+	if _, ok := c.Get(1); ok {
+		t.Fatalf("Get(1) found after Delete")
+	}
+	if v, ok := c.Get(2); !ok || v != "two" {
+		t.Fatalf("Get(2) = %v, %v", v, ok)
+	}
+}
+
+// TestCacheEvictionUsesOriginalKey guards against a reviewer-reported bug:
+// OnEvictFunc must be called with the key the caller gave to Namespace.Set,
+// not the internal namespace-transformed key used to address the shard.
+func TestCacheEvictionUsesOriginalKey(t *testing.T) {
+	var mu sync.Mutex
+	var evictedKeys []uint64
+
+	c := NewCache(1, 4, 2, func(key uint64, value interface{}) {
+		mu.Lock()
+		evictedKeys = append(evictedKeys, key)
+		mu.Unlock()
+	})
+	defer c.Close()
+
+	ns := c.Namespace(7)
+	ns.Set(1, "a")
+	ns.Set(2, "b")
+	ns.Set(3, "c") // shard capacity is 2, so this evicts key 1
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evictedKeys) != 1 || evictedKeys[0] != 1 {
+		t.Fatalf("OnEvict saw keys %v, want [1] (the caller's original key)", evictedKeys)
+	}
+}
+
+func TestCachePurgeNamespaceUsesOriginalKey(t *testing.T) {
+	var mu sync.Mutex
+	purged := make(map[uint64]interface{})
+
+	c := NewCache(4, 8, 0, func(key uint64, value interface{}) {
+		mu.Lock()
+		purged[key] = value
+		mu.Unlock()
+	})
+	defer c.Close()
+
+	ns := c.Namespace(42)
+	ns.Set(10, "ten")
+	ns.Set(20, "twenty")
+	c.Set(10, "unrelated") // same logical key, default namespace -- must survive the purge
+
+	c.PurgeNamespace(42)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if purged[10] != "ten" || purged[20] != "twenty" {
+		t.Fatalf("purged = %v, want original keys 10 and 20", purged)
+	}
+	if v, ok := c.Get(10); !ok || v != "unrelated" {
+		t.Fatalf("unrelated entry under key 10 was affected by purge: %v, %v", v, ok)
+	}
+}
+
+// TestCachePurgeNamespaceZeroSparesPlainEntries reproduces a reviewer-reported
+// bug: a plain Cache.Set stored namespace 0 (the zero value), indistinguishable
+// from an entry written through Namespace(0), so PurgeNamespace(0) (and
+// ZapNamespace(0)) deleted ordinary, non-namespaced entries too.
+func TestCachePurgeNamespaceZeroSparesPlainEntries(t *testing.T) {
+	c := NewCache(4, 8, 0, nil)
+	defer c.Close()
+
+	c.Set(100, "plain")
+	c.Namespace(0).Set(200, "ns")
+
+	c.PurgeNamespace(0)
+
+	if v, ok := c.Get(100); !ok || v != "plain" {
+		t.Fatalf("plain entry under key 100 was affected by PurgeNamespace(0): %v, %v", v, ok)
+	}
+	if _, ok := c.Namespace(0).Get(200); ok {
+		t.Fatalf("Namespace(0) entry under key 200 survived PurgeNamespace(0)")
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := NewCache(8, 16, 64, nil)
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for g := uint64(0); g < 8; g++ {
+		wg.Add(1)
+		go func(g uint64) {
+			defer wg.Done()
+			for i := uint64(0); i < 1000; i++ {
+				key := g*1000 + i
+				c.Set(key, key)
+				c.Get(key)
+				if i%7 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+package offheap
+
+// integerHash is Thomas Wang's 64-bit integer hash, the same mix used by the
+// public-domain C++ this package is ported from. It turns a key into the
+// value used throughout to pick a probe start / bucket index.
+func integerHash(key uint64) uint64 {
+	key = (^key) + (key << 21) // key = (key << 21) - key - 1
+	key = key ^ (key >> 24)
+	key = (key + (key << 3)) + (key << 8) // key * 265
+	key = key ^ (key >> 14)
+	key = (key + (key << 2)) + (key << 4) // key * 21
+	key = key ^ (key >> 28)
+	key = key + (key << 31)
+	return key
+}
+
+// upper_power_of_two rounds v up to the next power of two (v itself if it
+// already is one, 1 if v is 0). Used to size a table's bucket array.
+func upper_power_of_two(v uint64) uint64 {
+	if v == 0 {
+		return 1
+	}
+	v--
+	v |= v >> 1
+	v |= v >> 2
+	v |= v >> 4
+	v |= v >> 8
+	v |= v >> 16
+	v |= v >> 32
+	v++
+	return v
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package offheap
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// mmapAlloc reserves size bytes of anonymous, zero-filled memory outside the
+// Go heap via mmap(2). The returned slice is backed by that region; the GC
+// never scans it and never moves or frees it until mmapFree is called.
+func mmapAlloc(size uintptr) []byte {
+	if size == 0 {
+		return nil
+	}
+	b, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		panic(fmt.Sprintf("offheap: mmap of %d bytes failed: %v", size, err))
+	}
+	return b
+}
+
+// mmapFree releases a region previously returned by mmapAlloc.
+func mmapFree(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	if err := syscall.Munmap(b); err != nil {
+		panic(fmt.Sprintf("offheap: munmap failed: %v", err))
+	}
+}
@@ -0,0 +1,60 @@
+//go:build windows
+// +build windows
+
+package offheap
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	memCommit     = 0x1000
+	memReserve    = 0x2000
+	memRelease    = 0x8000
+	pageReadWrite = 0x04
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procVirtualAlloc = modkernel32.NewProc("VirtualAlloc")
+	procVirtualFree  = modkernel32.NewProc("VirtualFree")
+)
+
+// mmapAlloc reserves and commits size bytes of zero-filled memory outside the
+// Go heap via VirtualAlloc. The returned slice is backed by that region; the
+// GC never scans it and never moves or frees it until mmapFree is called.
+func mmapAlloc(size uintptr) []byte {
+	if size == 0 {
+		return nil
+	}
+	addr, _, err := procVirtualAlloc.Call(0, size, memCommit|memReserve, pageReadWrite)
+	if addr == 0 {
+		panic(fmt.Sprintf("offheap: VirtualAlloc of %d bytes failed: %v", size, err))
+	}
+	var b []byte
+	sh := (*sliceHeader)(unsafe.Pointer(&b))
+	sh.Data = addr
+	sh.Len = int(size)
+	sh.Cap = int(size)
+	return b
+}
+
+// mmapFree releases a region previously returned by mmapAlloc.
+func mmapFree(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	ok, _, err := procVirtualFree.Call(addr, 0, memRelease)
+	if ok == 0 {
+		panic(fmt.Sprintf("offheap: VirtualFree failed: %v", err))
+	}
+}
+
+type sliceHeader struct {
+	Data uintptr
+	Len  int
+	Cap  int
+}
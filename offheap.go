@@ -1,7 +1,6 @@
 package offheap
 
 import (
-	"fmt"
 	"unsafe"
 )
 
@@ -11,11 +10,20 @@ import (
 //  HashTable
 //
 //  Maps pointer-sized integers to pointer-sized integers.
-//  Uses open addressing with linear probing.
-//  In the t.cells array, Key = 0 is reserved to indicate an unused cell.
-//  Actual value for key 0 (if any) is stored in t.zeroCell.
-//  The hash table automatically doubles in size when it becomes 75% full.
-//  The hash table never shrinks in size, even after Clear(), unless you explicitly call Compact().
+//
+//  cells are grouped into fixed-size buckets (bucketCnt slots each) rather
+//  than probed linearly one at a time. Each bucket keeps a tophash byte per
+//  slot holding the high bits of that slot's key hash; a lookup scans the
+//  8-byte tophash array (one cache line) to find candidate slots and only
+//  touches the full Cell -- a uint64 plus an interface{} -- on a tophash
+//  match. A bucket that fills up chains to an overflow bucket instead of
+//  spilling into neighboring buckets.
+//
+//  The hash table automatically doubles its bucket count when it becomes
+//  75% full. Growth is incremental: Insert/Lookup/DeleteKey each evacuate a
+//  few old buckets into the new array before doing their own work, so no
+//  single call pays for migrating the whole table. The table never shrinks,
+//  even after Clear(), unless you explicitly call Compact().
 //----------------------------------------------
 
 type Cell struct {
@@ -23,200 +31,376 @@ type Cell struct {
 	Value interface{}
 }
 
+const (
+	bucketCnt = 8
+
+	// tophash sentinels. Actual tophash values are drawn from [minTopHash, 255],
+	// leaving 0 and 1 free to mark a slot's state without needing Key == 0 as a
+	// reserved "empty" sentinel the way the original linear-probing layout did.
+	tophashEmpty uint8 = 0
+	tophashTomb  uint8 = 1
+	minTopHash   uint8 = 2
+)
+
+type bucket struct {
+	tophash  [bucketCnt]uint8
+	cells    [bucketCnt]Cell
+	overflow *bucket
+}
+
 type HashTable struct {
-	cells      []Cell
-	arraySize  uint64
+	region     []byte
+	buckets    []bucket
+	bucketMask uint64 // len(buckets)-1; bucket count is always a power of 2
 	population uint64
-	zeroUsed   bool
-	zeroCell   Cell
+
+	// Growth in progress, if any: oldBuckets is the array being evacuated
+	// into buckets, evacuateProgress buckets have been processed so far. See
+	// beginGrowth/evacuateSome.
+	oldRegion        []byte
+	oldBuckets       []bucket
+	oldBucketMask    uint64
+	evacuateProgress uint64
+
+	// retiredRegions holds off-heap regions from growths that finished
+	// evacuating while pinnedIterators was non-zero, so some bucketWalker
+	// created by NewIterator might still hold its own slice header pointing
+	// into one of them (see NewIterator). Unmapping a region out from under
+	// a live Iterator would be a use-after-free, so these stay mapped until
+	// pinnedIterators drops back to zero (or, failing that, until
+	// DestroyHashTable unmaps everything at once). When no Iterator is
+	// outstanding, evacuateSome frees a finished oldRegion immediately
+	// instead of retiring it, so a table that grows repeatedly without ever
+	// being iterated doesn't leak a region per growth.
+	retiredRegions [][]byte
+
+	// pinnedIterators counts live Iterators whose oldWalk hasn't finished
+	// draining the old array it was given at creation. See NewIterator and
+	// Iterator.Next.
+	pinnedIterators uint64
+}
+
+// evacuatePerOp bounds how many old buckets (and their overflow chains)
+// beginGrowth's evacuation moves on each Insert/Lookup/DeleteKey call, so a
+// table crossing its load-factor threshold never pauses the caller for the
+// whole table at once.
+const evacuatePerOp = 2
+
+// growing reports whether a growth started by beginGrowth is still being
+// evacuated.
+func (t *HashTable) growing() bool {
+	return t.oldBuckets != nil
+}
+
+// topHash extracts the tophash byte for a full key hash, nudging it past the
+// two reserved sentinel values.
+func topHash(h uint64) uint8 {
+	top := uint8(h >> 56)
+	if top < minTopHash {
+		top += minTopHash
+	}
+	return top
+}
+
+// bucketArray mmaps a region large enough to hold n buckets and returns both
+// the backing region (for later unmapping) and a []bucket view over it.
+//
+// Overflow buckets are allocated normally (on the Go heap) when a bucket's
+// 8 slots fill up; only the primary array lives off-heap. Cell.Value is an
+// interface{}, which carries a type pointer and (usually) a data pointer --
+// those are invisible to the garbage collector once they live in mmap'd
+// memory, so a HashTable holding anything but immediate, pointer-free values
+// is not actually safe to run off-heap. Use RawHashTable instead when that
+// matters.
+func bucketArray(n uint64) ([]byte, []bucket) {
+	region := mmapAlloc(uintptr(n) * unsafe.Sizeof(bucket{}))
+	if n == 0 {
+		return region, nil
+	}
+	return region, (*[1 << 40]bucket)(unsafe.Pointer(&region[0]))[:n:n]
+}
+
+// bucketCountFor picks the smallest power-of-2 bucket count whose slots can
+// hold capacity cells. It leaves no load-factor headroom; callers that want
+// it (like Compact) scale capacity up first.
+func bucketCountFor(capacity uint64) uint64 {
+	n := upper_power_of_two((capacity + bucketCnt - 1) / bucketCnt)
+	if n == 0 {
+		n = 1
+	}
+	return n
 }
 
 func NewHashTable(initialSize uint64) *HashTable {
+	bucketCount := bucketCountFor(initialSize)
+	region, buckets := bucketArray(bucketCount)
 	return &HashTable{
-		// todo: allocate this off-heap instead
-		cells:     make([]Cell, initialSize),
-		arraySize: initialSize,
+		region:     region,
+		buckets:    buckets,
+		bucketMask: bucketCount - 1,
 	}
 }
 
+// DestroyHashTable unmaps the table's off-heap storage. The table must not be
+// used afterwards.
 func (t *HashTable) DestroyHashTable() {
-	// todo: release the off-heap allocation here
+	mmapFree(t.region)
+	t.region = nil
+	t.buckets = nil
+	if t.oldRegion != nil {
+		mmapFree(t.oldRegion)
+		t.oldRegion = nil
+		t.oldBuckets = nil
+	}
+	for _, region := range t.retiredRegions {
+		mmapFree(region)
+	}
+	t.retiredRegions = nil
+}
+
+// searchBucket scans a bucket and its overflow chain for key, using top to
+// skip slots whose tophash can't match before touching the full Cell.
+func searchBucket(b *bucket, top uint8, key uint64) *Cell {
+	for b != nil {
+		for i := 0; i < bucketCnt; i++ {
+			if b.tophash[i] == top && b.cells[i].Key == key {
+				return &b.cells[i]
+			}
+		}
+		b = b.overflow
+	}
+	return nil
 }
 
 // Basic operations
 func (t *HashTable) Lookup(key uint64) *Cell {
 
-	var cell *Cell
-
-	if key == 0 {
-		if t.zeroUsed {
-			return &t.zeroCell
-		}
-		return nil
-
-	} else {
+	t.evacuateSome()
 
-		h := integerHash(uint64(key)) % t.arraySize
+	h := integerHash(key)
+	top := topHash(h)
 
-		for {
-			cell = &(t.cells[h])
-			if cell.Key == key {
-				return cell
-			}
-			if cell.Key == 0 {
-				return nil
-			}
-			h++
-			if h == t.arraySize {
-				h = 0
-			}
-		}
+	if cell := searchBucket(&t.buckets[h&t.bucketMask], top, key); cell != nil {
+		return cell
 	}
+	if t.oldBuckets != nil {
+		return searchBucket(&t.oldBuckets[h&t.oldBucketMask], top, key)
+	}
+	return nil
 }
 
 // 2nd return value is false if already existed (and thus took no action)
 func (t *HashTable) Insert(key uint64) (*Cell, bool) {
 
-	var cell *Cell
+	t.evacuateSome()
 
-	if key != 0 {
+	h := integerHash(key)
+	top := topHash(h)
 
-		for {
-			h := integerHash(uint64(key)) % t.arraySize
+	if t.oldBuckets != nil {
+		if cell := searchBucket(&t.oldBuckets[h&t.oldBucketMask], top, key); cell != nil {
+			return cell, false
+		}
+	}
 
-			for {
-				cell = &(t.cells[h])
+	for {
+		var freeBucket *bucket
+		var freeSlot int
 
-				if cell.Key == key {
-					// already exists
-					return cell, false
+		b := &t.buckets[h&t.bucketMask]
+		for {
+			for i := 0; i < bucketCnt; i++ {
+				if b.tophash[i] == top && b.cells[i].Key == key {
+					return &b.cells[i], false
 				}
-				if cell.Key == 0 {
-					if (t.population+1)*4 >= t.arraySize*3 {
-						t.Repopulate(t.arraySize * 2)
-						// resized, so start all over
-						break
-					}
-					t.population++
-					cell.Key = key
-					return cell, true
+				if freeBucket == nil && b.tophash[i] < minTopHash {
+					freeBucket = b
+					freeSlot = i
 				}
+			}
+			if b.overflow == nil {
+				break
+			}
+			b = b.overflow
+		}
 
-				h++
-				if h == t.arraySize {
-					h = 0
-				}
+		if (t.population+1)*4 >= uint64(len(t.buckets))*bucketCnt*3 && !t.growing() {
+			t.beginGrowth((t.bucketMask + 1) * 2)
+			// resized, so start all over
+			continue
+		}
 
-			}
+		if freeBucket == nil {
+			freeBucket = &bucket{}
+			b.overflow = freeBucket
+			freeSlot = 0
 		}
-	} else {
 
-		if !t.zeroUsed {
+		freeBucket.tophash[freeSlot] = top
+		freeBucket.cells[freeSlot].Key = key
+		t.population++
+		return &freeBucket.cells[freeSlot], true
+	}
+}
+
+// beginGrowth starts an incremental grow to desiredBucketCount: the new
+// array is allocated immediately, but the old one is kept around (as
+// oldBuckets) and walked a few buckets at a time by evacuateSome, rather
+// than migrating every live cell in one stop-the-world pass like Repopulate
+// does.
+func (t *HashTable) beginGrowth(desiredBucketCount uint64) {
+	if desiredBucketCount&(desiredBucketCount-1) != 0 {
+		panic("desired bucket count must be a power of 2")
+	}
+
+	t.oldRegion = t.region
+	t.oldBuckets = t.buckets
+	t.oldBucketMask = t.bucketMask
+	t.evacuateProgress = 0
 
-			t.zeroUsed = true
-			t.population++
-			if t.population*4 >= t.arraySize*3 {
+	t.region, t.buckets = bucketArray(desiredBucketCount)
+	t.bucketMask = desiredBucketCount - 1
+}
 
-				t.Repopulate(t.arraySize * 2)
+// reinsert places a (key, value) pair known not to exist yet into the
+// current bucket array, without touching population or checking the load
+// factor. Used to move cells during evacuation and Repopulate, where the
+// destination array is already sized to hold them.
+func (t *HashTable) reinsert(key uint64, value interface{}) {
+	h := integerHash(key)
+	top := topHash(h)
+	b := &t.buckets[h&t.bucketMask]
+
+	for {
+		for i := 0; i < bucketCnt; i++ {
+			if b.tophash[i] < minTopHash {
+				b.tophash[i] = top
+				b.cells[i] = Cell{Key: key, Value: value}
+				return
 			}
 		}
-		return &t.zeroCell, true
+		if b.overflow == nil {
+			b.overflow = &bucket{}
+		}
+		b = b.overflow
 	}
-
 }
 
-func (t *HashTable) DeleteCell(cell *Cell) {
-
-	if cell == &t.zeroCell {
-		// Delete zero cell
-		if !t.zeroUsed {
-			panic("deleting zero element when not used")
-		}
-		t.zeroUsed = false
-		cell.Value = nil
-		t.population--
+// evacuateSome migrates up to evacuatePerOp old buckets (and their overflow
+// chains) from oldBuckets into buckets, clearing each source slot as it's
+// moved so later lookups against oldBuckets correctly find nothing there.
+// Once the whole old array has been walked, the growth is complete and the
+// old region is unmapped, or retired while an Iterator pins it.
+func (t *HashTable) evacuateSome() {
+	if t.oldBuckets == nil {
 		return
+	}
 
-	} else {
-
-		pos := uint64((uintptr(unsafe.Pointer(cell)) - uintptr(unsafe.Pointer(&t.cells[0]))) / uintptr(unsafe.Sizeof(Cell{})))
-
-		// Delete from regular cells
-		if pos < 0 || pos >= t.arraySize {
-			panic(fmt.Sprintf("cell out of bounds: pos %v was < 0 or >= t.arraySize == %v", pos, t.arraySize))
-		}
-		if t.cells[pos].Key == 0 {
-			panic("zero Key in non-zero Cell!")
+	for i := 0; i < evacuatePerOp && t.evacuateProgress < uint64(len(t.oldBuckets)); i++ {
+		b := &t.oldBuckets[t.evacuateProgress]
+		for b != nil {
+			for j := 0; j < bucketCnt; j++ {
+				if b.tophash[j] >= minTopHash {
+					t.reinsert(b.cells[j].Key, b.cells[j].Value)
+					b.tophash[j] = tophashEmpty
+					b.cells[j] = Cell{}
+				}
+			}
+			b = b.overflow
 		}
+		t.evacuateProgress++
+	}
 
-		// Remove this cell by shuffling neighboring cells so there are no gaps in anyone's probe chain
-		nei := pos + 1
-		if nei >= t.arraySize {
-			nei = 0
+	if t.evacuateProgress >= uint64(len(t.oldBuckets)) {
+		if t.pinnedIterators == 0 {
+			// No Iterator holds a view into the old array, so it's safe to
+			// unmap right away.
+			mmapFree(t.oldRegion)
+		} else {
+			// A bucketWalker created by NewIterator before this growth
+			// finished may still be walking t.oldBuckets directly, so the
+			// region can't be unmapped yet -- retire it instead. It'll be
+			// freed once pinnedIterators drops back to zero, or at worst
+			// when DestroyHashTable reclaims everything.
+			t.retiredRegions = append(t.retiredRegions, t.oldRegion)
 		}
-		var neighbor *Cell
-		var circular_offset_ideal_pos int64
-		var circular_offset_ideal_nei int64
+		t.oldRegion = nil
+		t.oldBuckets = nil
+		t.oldBucketMask = 0
+		t.evacuateProgress = 0
+	}
+}
 
-		for {
-			neighbor = &t.cells[nei]
+// releaseRetiredRegions frees every region retired by evacuateSome while an
+// Iterator was pinning the table, if none is pinning it any longer.
+func (t *HashTable) releaseRetiredRegions() {
+	if t.pinnedIterators != 0 || len(t.retiredRegions) == 0 {
+		return
+	}
+	for _, region := range t.retiredRegions {
+		mmapFree(region)
+	}
+	t.retiredRegions = nil
+}
 
-			if neighbor.Key == 0 {
-				// There's nobody to swap with. Go ahead and clear this cell, then return
-				t.cells[pos].Key = 0
-				t.cells[pos].Value = nil
-				t.population--
-				return
+// locateInChain finds which bucket and slot in b's chain holds cell.
+func locateInChain(b *bucket, cell *Cell) (*bucket, int, bool) {
+	for b != nil {
+		for i := range b.cells {
+			if &b.cells[i] == cell {
+				return b, i, true
 			}
+		}
+		b = b.overflow
+	}
+	return nil, 0, false
+}
 
-			ideal := integerHash(neighbor.Key) % t.arraySize
-
-			if pos >= ideal {
-				circular_offset_ideal_pos = int64(pos) - int64(ideal)
-			} else {
-				// pos < ideal, so pos - ideal is negative, wrap-around has happened.
-				circular_offset_ideal_pos = int64(t.arraySize) - int64(ideal) + int64(pos)
-			}
+func (t *HashTable) DeleteCell(cell *Cell) {
 
-			if nei >= ideal {
-				circular_offset_ideal_nei = int64(nei) - int64(ideal)
-			} else {
-				// nei < ideal, so nei - ideal is negative, wrap-around has happened.
-				circular_offset_ideal_nei = int64(t.arraySize) - int64(ideal) + int64(nei)
-			}
+	h := integerHash(cell.Key)
 
-			if circular_offset_ideal_pos < circular_offset_ideal_nei {
-				// Swap with neighbor, then make neighbor the new cell to remove.
-				t.cells[pos] = *neighbor
-				pos = nei
-			}
+	if b, i, ok := locateInChain(&t.buckets[h&t.bucketMask], cell); ok {
+		b.tophash[i] = tophashTomb
+		cell.Key = 0
+		cell.Value = nil
+		t.population--
+		return
+	}
 
-			nei++
-			if nei >= t.arraySize {
-				nei = 0
-			}
+	if t.oldBuckets != nil {
+		if b, i, ok := locateInChain(&t.oldBuckets[h&t.oldBucketMask], cell); ok {
+			b.tophash[i] = tophashTomb
+			cell.Key = 0
+			cell.Value = nil
+			t.population--
+			return
 		}
 	}
 
+	panic("cell not found in table")
 }
 
 func (t *HashTable) Clear() {
 	// (Does not resize the array)
-	// Clear regular cells
-
-	// todo, change to use off heap memory
-	for i := range t.cells {
-		t.cells[i] = Cell{}
+	t.finishGrowth()
+	for i := range t.buckets {
+		t.buckets[i] = bucket{}
 	}
 	t.population = 0
-
-	// Clear zero cell
-	t.zeroUsed = false
-	t.zeroCell.Value = 0
 }
 
 func (t *HashTable) Compact() {
-	t.Repopulate(upper_power_of_two((t.population*4 + 3) / 3))
+	t.finishGrowth()
+	t.Repopulate(bucketCountFor((t.population*4 + 2) / 3))
+}
+
+// finishGrowth drives any in-progress incremental growth to completion.
+// Repopulate needs a single, settled array to work from.
+func (t *HashTable) finishGrowth() {
+	for t.oldBuckets != nil {
+		t.evacuateSome()
+	}
 }
 
 func (t *HashTable) DeleteKey(key uint64) {
@@ -226,103 +410,136 @@ func (t *HashTable) DeleteKey(key uint64) {
 	}
 }
 
-func (t *HashTable) Repopulate(desiredSize uint64) {
+// Repopulate migrates every live cell into a freshly sized array of
+// desiredBucketCount buckets in one stop-the-world pass. Prefer letting
+// Insert trigger beginGrowth, which spreads that cost across subsequent
+// calls instead of pausing the caller; Repopulate remains for Compact, which
+// needs a single settled array anyway.
+func (t *HashTable) Repopulate(desiredBucketCount uint64) {
 
-	if desiredSize&(desiredSize-1) != 0 {
-		panic("desired size must be a power of 2")
+	t.finishGrowth()
+
+	if desiredBucketCount&(desiredBucketCount-1) != 0 {
+		panic("desired bucket count must be a power of 2")
 	}
-	if t.population*4 > desiredSize*3 {
-		panic("must have t.population * 4  <= desiredSize * 3")
+	if t.population*4 > desiredBucketCount*bucketCnt*3 {
+		panic("must have t.population * 4 <= desiredBucketCount * bucketCnt * 3")
 	}
 
-	// Get start/end pointers of old array
-	oldCells := t.cells
-
-	// Allocate new array
-	t.arraySize = desiredSize
-	t.cells = make([]Cell, t.arraySize)
+	oldRegion := t.region
+	oldBuckets := t.buckets
 
-	// Iterate through old array
-	// (any zero entry can stay in place; so ignore Key == 0 below).
-	var c *Cell
-	var pos uint64
-	for i := range oldCells {
-		{
-			c = &oldCells[i]
-			if c.Key != 0 {
-				// Insert this element into new array
-				pos = integerHash(c.Key) % t.arraySize
+	t.region, t.buckets = bucketArray(desiredBucketCount)
+	t.bucketMask = desiredBucketCount - 1
 
-				// for ;; cell = ((cell) + 1 != t.cells + t.arraySize ? (cell) + 1 : t.cells))
-				// for (Cell* cell = FIRST_CELL(integerHash(c.Key));; cell = CIRCULAR_NEXT(cell))
-
-				for {
-					cell := &t.cells[pos]
-
-					if cell.Key != 0 {
-						// Insert here
-						*cell = *c
-						break
-					}
-					pos++
-					if pos >= t.arraySize {
-						pos = 0
-					}
+	for i := range oldBuckets {
+		b := &oldBuckets[i]
+		for b != nil {
+			for j := 0; j < bucketCnt; j++ {
+				if b.tophash[j] >= minTopHash {
+					t.reinsert(b.cells[j].Key, b.cells[j].Value)
 				}
 			}
+			b = b.overflow
 		}
-
-		// Delete old array; happens when oldCells goes out of scope
-		// todo: delete in off-heap space
 	}
+
+	mmapFree(oldRegion)
 }
 
 //----------------------------------------------
 //  Iterator
 //----------------------------------------------
 
+// bucketWalker yields every occupied Cell in a bucket array, following
+// overflow chains as it goes.
+type bucketWalker struct {
+	buckets []bucket
+	idx     int64
+	b       *bucket
+	slot    int
+}
+
+func newBucketWalker(buckets []bucket) *bucketWalker {
+	return &bucketWalker{buckets: buckets, idx: -1}
+}
+
+func (w *bucketWalker) next() *Cell {
+	for {
+		if w.b == nil {
+			w.idx++
+			if w.idx >= int64(len(w.buckets)) {
+				return nil
+			}
+			w.b = &w.buckets[w.idx]
+			w.slot = 0
+		}
+
+		for w.slot < bucketCnt {
+			i := w.slot
+			w.slot++
+			if w.b.tophash[i] >= minTopHash {
+				return &w.b.cells[i]
+			}
+		}
+
+		w.b = w.b.overflow
+		w.slot = 0
+	}
+}
+
 type Iterator struct {
 	Tab *HashTable
-	Pos int64
 	Cur *Cell // nil when done
+
+	// Set when a growth was in progress at creation: oldWalk walks whatever
+	// of Tab.oldBuckets hasn't been evacuated yet, and seen records keys
+	// already yielded from there so the later walk of Tab.buckets doesn't
+	// return them a second time if they're evacuated mid-iteration.
+	oldWalk *bucketWalker
+	walk    *bucketWalker
+	seen    map[uint64]bool
 }
 
 func NewIterator(tab *HashTable) *Iterator {
 	it := &Iterator{
-		Tab: tab,
-		Cur: &tab.zeroCell,
+		Tab:  tab,
+		walk: newBucketWalker(tab.buckets),
 	}
 
-	if !it.Tab.zeroUsed {
-		it.Next()
+	if tab.oldBuckets != nil {
+		it.oldWalk = newBucketWalker(tab.oldBuckets)
+		it.seen = make(map[uint64]bool)
+		tab.pinnedIterators++
 	}
 
+	it.Next()
+
 	return it
 }
 
 func (it *Iterator) Next() *Cell {
 
-	// Already finished?
-	if it.Cur == nil {
-		return nil
-	}
-
-	// Iterate past zero cell
-	if it.Cur == &it.Tab.zeroCell {
-		it.Pos = -1
+	if it.oldWalk != nil {
+		if cell := it.oldWalk.next(); cell != nil {
+			it.seen[cell.Key] = true
+			it.Cur = cell
+			return it.Cur
+		}
+		it.oldWalk = nil
+		it.Tab.pinnedIterators--
+		it.Tab.releaseRetiredRegions()
 	}
 
-	// Iterate through the regular cells
-	it.Pos++
-	for uint64(it.Pos) != it.Tab.arraySize {
-		it.Cur = &it.Tab.cells[it.Pos]
-		if it.Cur.Key != 0 {
+	for {
+		cell := it.walk.next()
+		if cell == nil {
+			it.Cur = nil
+			return nil
+		}
+		if it.seen == nil || !it.seen[cell.Key] {
+			it.Cur = cell
 			return it.Cur
 		}
-		it.Pos++
 	}
-
-	// Finished
-	it.Cur = nil
-	return nil
 }
@@ -0,0 +1,163 @@
+package offheap
+
+import "testing"
+
+func TestHashTableInsertLookupDelete(t *testing.T) {
+	tab := NewHashTable(16)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(1); i <= 100; i++ {
+		cell, created := tab.Insert(i)
+		if !created {
+			t.Fatalf("Insert(%d): expected a new cell", i)
+		}
+		cell.Value = i * 2
+	}
+
+	for i := uint64(1); i <= 100; i++ {
+		cell := tab.Lookup(i)
+		if cell == nil {
+			t.Fatalf("Lookup(%d): not found", i)
+		}
+		if cell.Value.(uint64) != i*2 {
+			t.Fatalf("Lookup(%d): got %v, want %d", i, cell.Value, i*2)
+		}
+	}
+
+	tab.DeleteKey(50)
+	if tab.Lookup(50) != nil {
+		t.Fatalf("Lookup(50): found after DeleteKey")
+	}
+}
+
+// TestIteratorSurvivesGrowthCompletion reproduces the crash a reviewer hit:
+// an Iterator created while a growth is in progress must stay valid even
+// after a later Insert finishes evacuating (and would otherwise free) the
+// old array it's still walking.
+func TestIteratorSurvivesGrowthCompletion(t *testing.T) {
+	tab := NewHashTable(8)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(1); !tab.growing(); i++ {
+		cell, _ := tab.Insert(i)
+		cell.Value = i
+	}
+
+	it := NewIterator(tab)
+
+	// Drive enough ordinary Inserts to finish evacuating the old array while
+	// the Iterator above is still alive and has not finished its own walk.
+	for n := uint64(100); tab.growing(); n++ {
+		c, _ := tab.Insert(n)
+		c.Value = n
+	}
+
+	// The old array's memory is still mapped (its region is retired, not
+	// freed, until this Iterator finishes walking it), so walking it here
+	// must not fault. The walker aliases the same storage the now-finished
+	// evacuation wrote to, so the cell it is positioned on may have been
+	// cleared out from under it -- that's a zeroed, clearly-empty Cell{}, not
+	// garbage, and is the only allowed deviation from what was inserted
+	// before NewIterator.
+	seen := make(map[uint64]bool)
+	for ; it.Cur != nil; it.Next() {
+		if it.Cur.Key == 0 {
+			continue
+		}
+		if seen[it.Cur.Key] {
+			t.Fatalf("iterator returned key %d twice", it.Cur.Key)
+		}
+		seen[it.Cur.Key] = true
+		if it.Cur.Value.(uint64) != it.Cur.Key {
+			t.Fatalf("key %d has wrong value %v", it.Cur.Key, it.Cur.Value)
+		}
+	}
+}
+
+// TestClearDuringGrowth reproduces a reviewer-reported bug: Clear() wiped
+// only the new bucket array and reset population to 0 without touching a
+// growth in progress, so oldBuckets stayed fully reachable and "cleared"
+// keys kept turning up in Lookup (and double-deleting one underflowed
+// population).
+func TestClearDuringGrowth(t *testing.T) {
+	tab := NewHashTable(8)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(1); !tab.growing(); i++ {
+		cell, _ := tab.Insert(i)
+		cell.Value = i
+	}
+	if !tab.growing() {
+		t.Fatalf("expected table to be growing")
+	}
+
+	tab.Clear()
+
+	if tab.growing() {
+		t.Fatalf("Clear should finish any in-progress growth")
+	}
+	if tab.population != 0 {
+		t.Fatalf("population = %d, want 0 after Clear", tab.population)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if tab.Lookup(i) != nil {
+			t.Fatalf("Lookup(%d): found a key that Clear should have removed", i)
+		}
+	}
+}
+
+// TestGrowthWithoutIteratorDoesNotRetireRegions reproduces a reviewer-reported
+// leak: evacuateSome used to retire every finished oldRegion unconditionally,
+// even when no Iterator existed to need it kept mapped, so a long-lived table
+// that grows repeatedly leaked one region per growth forever.
+func TestGrowthWithoutIteratorDoesNotRetireRegions(t *testing.T) {
+	tab := NewHashTable(8)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(1); i <= 100000; i++ {
+		cell, created := tab.Insert(i)
+		if created {
+			cell.Value = i
+		}
+	}
+
+	if len(tab.retiredRegions) != 0 {
+		t.Fatalf("retiredRegions = %d, want 0: no Iterator was ever created", len(tab.retiredRegions))
+	}
+}
+
+// TestIteratorPinReleasesRetiredRegionsWhenDone checks that regions retired
+// while an Iterator was outstanding are freed once it finishes draining its
+// old-array walk, rather than only ever being reclaimed by DestroyHashTable.
+func TestIteratorPinReleasesRetiredRegionsWhenDone(t *testing.T) {
+	tab := NewHashTable(8)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(1); !tab.growing(); i++ {
+		cell, _ := tab.Insert(i)
+		cell.Value = i
+	}
+
+	it := NewIterator(tab)
+	if tab.pinnedIterators != 1 {
+		t.Fatalf("pinnedIterators = %d, want 1", tab.pinnedIterators)
+	}
+
+	for n := uint64(100); tab.growing(); n++ {
+		c, _ := tab.Insert(n)
+		c.Value = n
+	}
+	if len(tab.retiredRegions) == 0 {
+		t.Fatalf("expected the finished growth to retire a region while the Iterator was pinning it")
+	}
+
+	for ; it.Cur != nil; it.Next() {
+	}
+
+	if tab.pinnedIterators != 0 {
+		t.Fatalf("pinnedIterators = %d, want 0 once the Iterator is drained", tab.pinnedIterators)
+	}
+	if len(tab.retiredRegions) != 0 {
+		t.Fatalf("retiredRegions = %d, want 0 once the Iterator is drained", len(tab.retiredRegions))
+	}
+}
@@ -0,0 +1,257 @@
+package offheap
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+//----------------------------------------------
+//  RawHashTable
+//
+//  A simple open-addressing table with linear probing, same as the original
+//  (pre-bucketized) HashTable, but RawCell.Value is a fixed-size byte array
+//  instead of an interface{}. An interface{} carries a type pointer and
+//  (usually) a data pointer, so a Cell array backed by mmap'd memory still
+//  hides live GC pointers from the collector -- exactly the hazard the TODOs
+//  on HashTable originally warned about. RawCell has no pointers at all, so a
+//  RawHashTable is safe to keep entirely off-heap. Callers marshal their own
+//  values into and out of the fixed-width Value field.
+//----------------------------------------------
+
+// RawValueSize is the width, in bytes, of the Value payload stored in each
+// RawCell. Callers that need a larger payload should store an off-heap
+// pointer (see unsafe.Pointer conversions) in the leading bytes instead of
+// the value itself.
+const RawValueSize = 16
+
+type RawCell struct {
+	Key   uint64
+	Value [RawValueSize]byte
+}
+
+type RawHashTable struct {
+	region     []byte
+	cells      []RawCell
+	arraySize  uint64
+	population uint64
+	zeroUsed   bool
+	zeroCell   RawCell
+}
+
+func rawCellsRegion(n uint64) ([]byte, []RawCell) {
+	region := mmapAlloc(uintptr(n) * unsafe.Sizeof(RawCell{}))
+	if n == 0 {
+		return region, nil
+	}
+	return region, (*[1 << 40]RawCell)(unsafe.Pointer(&region[0]))[:n:n]
+}
+
+func NewRawHashTable(initialSize uint64) *RawHashTable {
+	region, cells := rawCellsRegion(initialSize)
+	return &RawHashTable{
+		region:    region,
+		cells:     cells,
+		arraySize: initialSize,
+	}
+}
+
+// DestroyRawHashTable unmaps the table's off-heap storage. The table must not
+// be used afterwards.
+func (t *RawHashTable) DestroyRawHashTable() {
+	mmapFree(t.region)
+	t.region = nil
+	t.cells = nil
+}
+
+func (t *RawHashTable) Lookup(key uint64) *RawCell {
+	var cell *RawCell
+
+	if key == 0 {
+		if t.zeroUsed {
+			return &t.zeroCell
+		}
+		return nil
+	}
+
+	h := integerHash(key) % t.arraySize
+	for {
+		cell = &(t.cells[h])
+		if cell.Key == key {
+			return cell
+		}
+		if cell.Key == 0 {
+			return nil
+		}
+		h++
+		if h == t.arraySize {
+			h = 0
+		}
+	}
+}
+
+// 2nd return value is false if already existed (and thus took no action)
+func (t *RawHashTable) Insert(key uint64) (*RawCell, bool) {
+	var cell *RawCell
+
+	if key != 0 {
+		for {
+			h := integerHash(key) % t.arraySize
+
+			for {
+				cell = &(t.cells[h])
+
+				if cell.Key == key {
+					return cell, false
+				}
+				if cell.Key == 0 {
+					if (t.population+1)*4 >= t.arraySize*3 {
+						t.Repopulate(t.arraySize * 2)
+						break
+					}
+					t.population++
+					cell.Key = key
+					return cell, true
+				}
+
+				h++
+				if h == t.arraySize {
+					h = 0
+				}
+			}
+		}
+	}
+
+	if !t.zeroUsed {
+		t.zeroUsed = true
+		t.population++
+		if t.population*4 >= t.arraySize*3 {
+			t.Repopulate(t.arraySize * 2)
+		}
+		return &t.zeroCell, true
+	}
+	return &t.zeroCell, false
+}
+
+func (t *RawHashTable) DeleteCell(cell *RawCell) {
+	if cell == &t.zeroCell {
+		if !t.zeroUsed {
+			panic("deleting zero element when not used")
+		}
+		t.zeroUsed = false
+		cell.Value = [RawValueSize]byte{}
+		t.population--
+		return
+	}
+
+	pos := uint64((uintptr(unsafe.Pointer(cell)) - uintptr(unsafe.Pointer(&t.cells[0]))) / unsafe.Sizeof(RawCell{}))
+
+	if pos >= t.arraySize {
+		panic(fmt.Sprintf("cell out of bounds: pos %v was >= t.arraySize == %v", pos, t.arraySize))
+	}
+	if t.cells[pos].Key == 0 {
+		panic("zero Key in non-zero Cell!")
+	}
+
+	nei := pos + 1
+	if nei >= t.arraySize {
+		nei = 0
+	}
+	var neighbor *RawCell
+	var circularOffsetIdealPos int64
+	var circularOffsetIdealNei int64
+
+	for {
+		neighbor = &t.cells[nei]
+
+		if neighbor.Key == 0 {
+			t.cells[pos].Key = 0
+			t.cells[pos].Value = [RawValueSize]byte{}
+			t.population--
+			return
+		}
+
+		ideal := integerHash(neighbor.Key) % t.arraySize
+
+		if pos >= ideal {
+			circularOffsetIdealPos = int64(pos) - int64(ideal)
+		} else {
+			circularOffsetIdealPos = int64(t.arraySize) - int64(ideal) + int64(pos)
+		}
+
+		if nei >= ideal {
+			circularOffsetIdealNei = int64(nei) - int64(ideal)
+		} else {
+			circularOffsetIdealNei = int64(t.arraySize) - int64(ideal) + int64(nei)
+		}
+
+		if circularOffsetIdealPos < circularOffsetIdealNei {
+			t.cells[pos] = *neighbor
+			pos = nei
+		}
+
+		nei++
+		if nei >= t.arraySize {
+			nei = 0
+		}
+	}
+}
+
+func (t *RawHashTable) Clear() {
+	for i := range t.cells {
+		t.cells[i] = RawCell{}
+	}
+	t.population = 0
+
+	t.zeroUsed = false
+	t.zeroCell.Value = [RawValueSize]byte{}
+}
+
+func (t *RawHashTable) Compact() {
+	t.Repopulate(upper_power_of_two((t.population*4 + 3) / 3))
+}
+
+func (t *RawHashTable) DeleteKey(key uint64) {
+	cell := t.Lookup(key)
+	if cell != nil {
+		t.DeleteCell(cell)
+	}
+}
+
+func (t *RawHashTable) Repopulate(desiredSize uint64) {
+	if desiredSize&(desiredSize-1) != 0 {
+		panic("desired size must be a power of 2")
+	}
+	if t.population*4 > desiredSize*3 {
+		panic("must have t.population * 4  <= desiredSize * 3")
+	}
+
+	oldRegion := t.region
+	oldCells := t.cells
+
+	t.arraySize = desiredSize
+	t.region, t.cells = rawCellsRegion(t.arraySize)
+
+	var c *RawCell
+	var pos uint64
+	for i := range oldCells {
+		c = &oldCells[i]
+		if c.Key != 0 {
+			pos = integerHash(c.Key) % t.arraySize
+
+			for {
+				cell := &t.cells[pos]
+
+				if cell.Key == 0 {
+					*cell = *c
+					break
+				}
+				pos++
+				if pos >= t.arraySize {
+					pos = 0
+				}
+			}
+		}
+	}
+
+	mmapFree(oldRegion)
+}
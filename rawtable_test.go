@@ -0,0 +1,39 @@
+package offheap
+
+import "testing"
+
+func TestRawHashTableInsertLookupDelete(t *testing.T) {
+	tab := NewRawHashTable(16)
+	defer tab.DestroyRawHashTable()
+
+	for i := uint64(0); i < 100; i++ {
+		cell, created := tab.Insert(i)
+		if !created {
+			t.Fatalf("Insert(%d): expected a new cell", i)
+		}
+		cell.Value[0] = byte(i)
+	}
+
+	for i := uint64(0); i < 100; i++ {
+		cell := tab.Lookup(i)
+		if cell == nil {
+			t.Fatalf("Lookup(%d): not found", i)
+		}
+		if cell.Value[0] != byte(i) {
+			t.Fatalf("Lookup(%d): got %v, want %d", i, cell.Value[0], byte(i))
+		}
+	}
+
+	tab.DeleteKey(50)
+	if tab.Lookup(50) != nil {
+		t.Fatalf("Lookup(50): found after DeleteKey")
+	}
+	for i := uint64(0); i < 100; i++ {
+		if i == 50 {
+			continue
+		}
+		if tab.Lookup(i) == nil {
+			t.Fatalf("Lookup(%d): lost after deleting an unrelated key", i)
+		}
+	}
+}
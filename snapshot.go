@@ -0,0 +1,212 @@
+package offheap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+//----------------------------------------------
+//  Snapshot / restore
+//
+//  WriteSnapshot and LoadSnapshot serialize a HashTable's live contents to a
+//  self-describing binary stream, so a long-lived off-heap table can survive
+//  a process restart without recomputing its contents. Values are encoded
+//  via a caller-supplied ValueCodec, so callers pick their own value
+//  encoding -- msgpack, gob, or raw bytes for fixed-size payloads.
+//----------------------------------------------
+
+// ValueCodec encodes and decodes Cell values for WriteSnapshot/LoadSnapshot.
+type ValueCodec interface {
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader) (interface{}, error)
+}
+
+const (
+	snapshotMagic   uint32 = 0x48415346 // "HASF": off-heap HASh snapshot File
+	snapshotVersion uint16 = 1
+
+	snapshotHeaderSize = 4 + 2 + 1 + 8 + 8 // magic, version, dense flag, bucketCount, population
+)
+
+// WriteSnapshot serializes the live contents of t to w, encoding values with
+// codec. If a growth is in progress, it is driven to completion first so the
+// snapshot reflects a single settled array.
+//
+// The body is written densely -- one presence byte per primary-array slot,
+// in array order, followed by the slots that spilled into overflow buckets
+// -- once the table is at least half full. Sparser tables are written as a
+// plain stream of (key, value) pairs instead. Both forms write every live
+// (key, value) pair in full; the dense form adds the presence bytes and an
+// overflow count on top. The choice is recorded in the header so
+// LoadSnapshot need not guess.
+func (t *HashTable) WriteSnapshot(w io.Writer, codec ValueCodec) error {
+	t.finishGrowth()
+
+	bw := bufio.NewWriter(w)
+
+	slotCount := uint64(len(t.buckets)) * bucketCnt
+	dense := slotCount > 0 && t.population*2 >= slotCount
+
+	if err := writeSnapshotHeader(bw, uint64(len(t.buckets)), t.population, dense); err != nil {
+		return err
+	}
+
+	var err error
+	if dense {
+		err = t.writeDenseBody(bw, codec)
+	} else {
+		err = t.writeSparseBody(bw, codec)
+	}
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+func writeSnapshotHeader(w io.Writer, bucketCount, population uint64, dense bool) error {
+	var hdr [snapshotHeaderSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], snapshotMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], snapshotVersion)
+	if dense {
+		hdr[6] = 1
+	}
+	binary.LittleEndian.PutUint64(hdr[7:15], bucketCount)
+	binary.LittleEndian.PutUint64(hdr[15:23], population)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+func writeSnapshotPair(w io.Writer, key uint64, value interface{}, codec ValueCodec) error {
+	var kb [8]byte
+	binary.LittleEndian.PutUint64(kb[:], key)
+	if _, err := w.Write(kb[:]); err != nil {
+		return err
+	}
+	return codec.Encode(w, value)
+}
+
+func (t *HashTable) writeSparseBody(w io.Writer, codec ValueCodec) error {
+	for it := NewIterator(t); it.Cur != nil; it.Next() {
+		if err := writeSnapshotPair(w, it.Cur.Key, it.Cur.Value, codec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *HashTable) writeDenseBody(w io.Writer, codec ValueCodec) error {
+	var presence [1]byte
+
+	var overflowCells []*Cell
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		for j := 0; j < bucketCnt; j++ {
+			if b.tophash[j] >= minTopHash {
+				presence[0] = 1
+			} else {
+				presence[0] = 0
+			}
+			if _, err := w.Write(presence[:]); err != nil {
+				return err
+			}
+			if presence[0] == 1 {
+				if err := writeSnapshotPair(w, b.cells[j].Key, b.cells[j].Value, codec); err != nil {
+					return err
+				}
+			}
+		}
+		for ob := b.overflow; ob != nil; ob = ob.overflow {
+			for j := 0; j < bucketCnt; j++ {
+				if ob.tophash[j] >= minTopHash {
+					overflowCells = append(overflowCells, &ob.cells[j])
+				}
+			}
+		}
+	}
+
+	var cnt [8]byte
+	binary.LittleEndian.PutUint64(cnt[:], uint64(len(overflowCells)))
+	if _, err := w.Write(cnt[:]); err != nil {
+		return err
+	}
+	for _, cell := range overflowCells {
+		if err := writeSnapshotPair(w, cell.Key, cell.Value, codec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot rebuilds a HashTable from a stream written by WriteSnapshot,
+// decoding values with codec. Keys are inserted one at a time into a freshly
+// sized array (rounded up to a power of two, as NewHashTable always does) so
+// probe chains come out correct for the new size rather than being copied
+// blindly from the old one.
+func LoadSnapshot(r io.Reader, codec ValueCodec) (*HashTable, error) {
+	br := bufio.NewReader(r)
+
+	var hdr [snapshotHeaderSize]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, fmt.Errorf("offheap: reading snapshot header: %w", err)
+	}
+	if magic := binary.LittleEndian.Uint32(hdr[0:4]); magic != snapshotMagic {
+		return nil, fmt.Errorf("offheap: not a snapshot (bad magic %#x)", magic)
+	}
+	if version := binary.LittleEndian.Uint16(hdr[4:6]); version != snapshotVersion {
+		return nil, fmt.Errorf("offheap: unsupported snapshot version %d", version)
+	}
+	dense := hdr[6] == 1
+	bucketCount := binary.LittleEndian.Uint64(hdr[7:15])
+	population := binary.LittleEndian.Uint64(hdr[15:23])
+
+	tab := NewHashTable(population)
+
+	readPair := func() error {
+		var kb [8]byte
+		if _, err := io.ReadFull(br, kb[:]); err != nil {
+			return err
+		}
+		value, err := codec.Decode(br)
+		if err != nil {
+			return err
+		}
+		cell, _ := tab.Insert(binary.LittleEndian.Uint64(kb[:]))
+		cell.Value = value
+		return nil
+	}
+
+	if dense {
+		for i := uint64(0); i < bucketCount*bucketCnt; i++ {
+			present, err := br.ReadByte()
+			if err != nil {
+				return nil, fmt.Errorf("offheap: reading snapshot body: %w", err)
+			}
+			if present == 1 {
+				if err := readPair(); err != nil {
+					return nil, fmt.Errorf("offheap: reading snapshot entry: %w", err)
+				}
+			}
+		}
+
+		var cnt [8]byte
+		if _, err := io.ReadFull(br, cnt[:]); err != nil {
+			return nil, fmt.Errorf("offheap: reading snapshot overflow count: %w", err)
+		}
+		for i, n := uint64(0), binary.LittleEndian.Uint64(cnt[:]); i < n; i++ {
+			if err := readPair(); err != nil {
+				return nil, fmt.Errorf("offheap: reading snapshot entry: %w", err)
+			}
+		}
+	} else {
+		for i := uint64(0); i < population; i++ {
+			if err := readPair(); err != nil {
+				return nil, fmt.Errorf("offheap: reading snapshot entry: %w", err)
+			}
+		}
+	}
+
+	return tab, nil
+}
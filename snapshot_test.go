@@ -0,0 +1,67 @@
+package offheap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// uint64Codec encodes values as raw 8-byte little-endian integers.
+type uint64Codec struct{}
+
+func (uint64Codec) Encode(w io.Writer, v interface{}) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v.(uint64))
+	_, err := w.Write(b[:])
+	return err
+}
+
+func (uint64Codec) Decode(r io.Reader) (interface{}, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+func testSnapshotRoundTrip(t *testing.T, population int) {
+	tab := NewHashTable(8)
+	defer tab.DestroyHashTable()
+
+	for i := uint64(0); i < uint64(population); i++ {
+		cell, _ := tab.Insert(i)
+		cell.Value = i * 2
+	}
+
+	var buf bytes.Buffer
+	if err := tab.WriteSnapshot(&buf, uint64Codec{}); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+
+	loaded, err := LoadSnapshot(&buf, uint64Codec{})
+	if err != nil {
+		t.Fatalf("LoadSnapshot: %v", err)
+	}
+	defer loaded.DestroyHashTable()
+
+	for i := uint64(0); i < uint64(population); i++ {
+		cell := loaded.Lookup(i)
+		if cell == nil {
+			t.Fatalf("key %d missing after round-trip", i)
+		}
+		if cell.Value.(uint64) != i*2 {
+			t.Fatalf("key %d: got %v, want %d", i, cell.Value, i*2)
+		}
+	}
+}
+
+func TestSnapshotRoundTripSparse(t *testing.T) {
+	testSnapshotRoundTrip(t, 3)
+}
+
+func TestSnapshotRoundTripDense(t *testing.T) {
+	// 80 keys settle into 16 buckets (128 slots), at least half full, so
+	// WriteSnapshot takes the dense path.
+	testSnapshotRoundTrip(t, 80)
+}